@@ -0,0 +1,211 @@
+// cache.go
+//
+// Cache abstracts the phantom-JWT store behind Get/Set/Delete so the plugin
+// can run with a single in-process map, or scale out across multiple Tyk
+// gateways via a shared Redis or etcd store without every instance
+// re-introspecting the same token.
+//
+// Selected via CACHE_BACKEND={memory,redis,etcd} (default "memory"); see
+// cache_redis.go and cache_etcd.go for the distributed backends, which
+// enforce TTL natively (SETEX, lease) instead of the in-memory janitor.
+//
+// Env vars:
+//
+//	CACHE_BACKEND (default "memory"), CACHE_KEY_PREFIX
+//	CACHE_MAX_ENTRIES (default 10000), CACHE_JANITOR_SECONDS (default 60) [memory backend only]
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	cacheBackend   = envOrDefault("CACHE_BACKEND", "memory")
+	cacheKeyPrefix = os.Getenv("CACHE_KEY_PREFIX")
+
+	janitorEvery = durationFromEnvSeconds("CACHE_JANITOR_SECONDS", 60)
+	cacheMax     = intFromEnv("CACHE_MAX_ENTRIES", 10000)
+)
+
+// Cache stores the phantom JWT for a hashed opaque token, with a
+// backend-enforced expiry. Implementations must be safe for concurrent use.
+type Cache interface {
+	Get(key string) (string, bool)
+	Set(key, value string, ttl time.Duration)
+	Delete(key string)
+}
+
+func newCache() (Cache, error) {
+	switch cacheBackend {
+	case "", "memory":
+		return newInstrumentedMemoryCache(jwtCacheMetrics), nil
+	case "redis":
+		return newRedisCache()
+	case "etcd":
+		return newEtcdCache()
+	default:
+		return nil, fmt.Errorf("unknown CACHE_BACKEND %q", cacheBackend)
+	}
+}
+
+func envOrDefault(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func boolFromEnv(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	return v == "1" || v == "true" || v == "TRUE"
+}
+
+// -------- In-memory backend --------
+
+type memoryEntry struct {
+	Value   string
+	Expires time.Time
+}
+
+type memoryCache struct {
+	mu      sync.RWMutex
+	data    map[string]memoryEntry
+	metrics *cacheMetrics // nil for caches other than cStore's memory backend
+}
+
+// newMemoryCache returns an uninstrumented in-memory cache, for call sites
+// (negativeCache in singleflight.go, claimsCache in policy.go) that are not
+// the phantom-JWT cache proper and must not share its metrics.
+func newMemoryCache() *memoryCache {
+	return newInstrumentedMemoryCache(nil)
+}
+
+// newInstrumentedMemoryCache is used for cStore, the actual phantom-JWT
+// cache, so phantom_cache_* metrics reflect that cache alone.
+func newInstrumentedMemoryCache(metrics *cacheMetrics) *memoryCache {
+	c := &memoryCache{data: make(map[string]memoryEntry, 1024), metrics: metrics}
+	go func() {
+		t := time.NewTicker(janitorEvery)
+		defer t.Stop()
+		for range t.C {
+			c.purgeExpired()
+			c.enforceCap()
+		}
+	}()
+	return c
+}
+
+func (c *memoryCache) Get(key string) (string, bool) {
+	now := time.Now()
+	c.mu.RLock()
+	me, ok := c.data[key]
+	c.mu.RUnlock()
+	if !ok {
+		if c.metrics != nil {
+			c.metrics.misses.Inc()
+		}
+		return "", false
+	}
+	if now.After(me.Expires) {
+		c.mu.Lock()
+		delete(c.data, key)
+		c.mu.Unlock()
+		if c.metrics != nil {
+			c.metrics.misses.Inc()
+		}
+		return "", false
+	}
+	if c.metrics != nil {
+		c.metrics.hits.Inc()
+	}
+	return me.Value, true
+}
+
+func (c *memoryCache) Set(key, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	c.data[key] = memoryEntry{Value: value, Expires: time.Now().Add(ttl)}
+	c.reportSizeLocked()
+	c.mu.Unlock()
+}
+
+func (c *memoryCache) Delete(key string) {
+	c.mu.Lock()
+	delete(c.data, key)
+	c.reportSizeLocked()
+	c.mu.Unlock()
+}
+
+func (c *memoryCache) purgeExpired() {
+	now := time.Now()
+	c.mu.Lock()
+	for k, v := range c.data {
+		if now.After(v.Expires) {
+			delete(c.data, k)
+			if c.metrics != nil {
+				c.metrics.evictions.WithLabelValues("expired").Inc()
+			}
+		}
+	}
+	c.reportSizeLocked()
+	c.mu.Unlock()
+}
+
+// reportSizeLocked updates the size gauge; caller must hold c.mu.
+func (c *memoryCache) reportSizeLocked() {
+	if c.metrics != nil {
+		c.metrics.size.Set(float64(len(c.data)))
+	}
+}
+
+func (c *memoryCache) enforceCap() {
+	if cacheMax <= 0 {
+		return
+	}
+	c.mu.Lock()
+	n := len(c.data)
+	if n <= cacheMax {
+		c.mu.Unlock()
+		return
+	}
+	toDrop := n - cacheMax
+	type kv struct {
+		key string
+		exp time.Time
+	}
+	items := make([]kv, 0, n)
+	for k, v := range c.data {
+		items = append(items, kv{k, v.Expires})
+	}
+	now := time.Now()
+	dropped := 0
+	for _, it := range items {
+		if dropped >= toDrop {
+			break
+		}
+		if !it.exp.After(now) || it.exp.Sub(now) < 2*time.Minute {
+			delete(c.data, it.key)
+			dropped++
+		}
+	}
+	for k := range c.data {
+		if dropped >= toDrop {
+			break
+		}
+		delete(c.data, k)
+		dropped++
+	}
+	if dropped > 0 && c.metrics != nil {
+		c.metrics.evictions.WithLabelValues("capacity").Add(float64(dropped))
+	}
+	c.reportSizeLocked()
+	c.mu.Unlock()
+}
@@ -0,0 +1,118 @@
+// cache_etcd.go
+//
+// etcd v3-backed Cache implementation. Each Set grants a lease for the TTL
+// and attaches it to the key, so expiry is enforced by etcd itself rather
+// than an in-process janitor (mirroring the lease-based storage pattern
+// used by dex's etcd storage driver).
+//
+// Env vars:
+//
+//	ETCD_ENDPOINTS (comma-separated)
+//	ETCD_TLS_CERT_FILE, ETCD_TLS_KEY_FILE, ETCD_TLS_CA_FILE
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type etcdCache struct {
+	client *clientv3.Client
+}
+
+func newEtcdCache() (*etcdCache, error) {
+	endpoints := os.Getenv("ETCD_ENDPOINTS")
+	if endpoints == "" {
+		return nil, fmt.Errorf("ETCD_ENDPOINTS must be set for CACHE_BACKEND=etcd")
+	}
+
+	cfg := clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: introspectTO,
+	}
+	tlsCfg, err := etcdTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.TLS = tlsCfg
+
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("etcd client: %w", err)
+	}
+	return &etcdCache{client: client}, nil
+}
+
+func etcdTLSConfig() (*tls.Config, error) {
+	certFile := os.Getenv("ETCD_TLS_CERT_FILE")
+	keyFile := os.Getenv("ETCD_TLS_KEY_FILE")
+	caFile := os.Getenv("ETCD_TLS_CA_FILE")
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("etcd client cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("etcd ca cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("etcd ca cert: invalid PEM in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func (c *etcdCache) Get(key string) (string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), introspectTO)
+	defer cancel()
+	resp, err := c.client.Get(ctx, cacheKeyPrefix+key)
+	if err != nil || len(resp.Kvs) == 0 {
+		cacheMissesTotal.Inc()
+		return "", false
+	}
+	cacheHitsTotal.Inc()
+	return string(resp.Kvs[0].Value), true
+}
+
+func (c *etcdCache) Set(key, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), introspectTO)
+	defer cancel()
+
+	lease, err := c.client.Grant(ctx, int64(ttl.Seconds()))
+	if err != nil {
+		logger.Warn("etcd grant lease failed", "error", err)
+		return
+	}
+	if _, err := c.client.Put(ctx, cacheKeyPrefix+key, value, clientv3.WithLease(lease.ID)); err != nil {
+		logger.Warn("etcd put failed", "error", err)
+	}
+}
+
+func (c *etcdCache) Delete(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), introspectTO)
+	defer cancel()
+	if _, err := c.client.Delete(ctx, cacheKeyPrefix+key); err != nil {
+		logger.Warn("etcd delete failed", "error", err)
+	}
+}
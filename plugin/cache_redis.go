@@ -0,0 +1,76 @@
+// cache_redis.go
+//
+// Redis-backed Cache implementation. Keys are namespaced with
+// CACHE_KEY_PREFIX; TTL is enforced natively via SETEX so expiry is a
+// property of the store rather than this process, and phantom JWTs stay
+// shared across every gateway instance pointed at the same Redis.
+//
+// Env vars:
+//
+//	REDIS_ADDR, REDIS_TLS (default "false")
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type redisCache struct {
+	client *redis.Client
+}
+
+func newRedisCache() (*redisCache, error) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		return nil, fmt.Errorf("REDIS_ADDR must be set for CACHE_BACKEND=redis")
+	}
+
+	opts := &redis.Options{Addr: addr}
+	if boolFromEnv("REDIS_TLS", false) {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), introspectTO)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("redis ping: %w", err)
+	}
+	return &redisCache{client: client}, nil
+}
+
+func (c *redisCache) Get(key string) (string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), introspectTO)
+	defer cancel()
+	v, err := c.client.Get(ctx, cacheKeyPrefix+key).Result()
+	if err != nil {
+		cacheMissesTotal.Inc()
+		return "", false
+	}
+	cacheHitsTotal.Inc()
+	return v, true
+}
+
+func (c *redisCache) Set(key, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), introspectTO)
+	defer cancel()
+	if err := c.client.SetEx(ctx, cacheKeyPrefix+key, value, ttl).Err(); err != nil {
+		logger.Warn("redis set failed", "error", err)
+	}
+}
+
+func (c *redisCache) Delete(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), introspectTO)
+	defer cancel()
+	if err := c.client.Del(ctx, cacheKeyPrefix+key).Err(); err != nil {
+		logger.Warn("redis delete failed", "error", err)
+	}
+}
@@ -0,0 +1,100 @@
+// discovery.go
+//
+// OIDC discovery bootstrap. Given ISSUER_URL, fetches
+// .well-known/openid-configuration and keeps the most recently successful
+// document available to both the introspection client (oauthclient.go) and
+// the local JWKS validator (keymanager.go). A background timer rediscovers
+// periodically; a failed refresh logs and keeps serving the last-known-good
+// document rather than taking the plugin down.
+//
+// Env vars:
+//
+//	ISSUER_URL, DISCOVERY_REFRESH_SECONDS (default 3600)
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	issuerURL             = os.Getenv("ISSUER_URL")
+	discoveryRefreshEvery = durationFromEnvSeconds("DISCOVERY_REFRESH_SECONDS", 3600)
+)
+
+// oidcDiscoveryDoc is the subset of RFC 8414 / OpenID Connect Discovery 1.0
+// fields this plugin cares about.
+type oidcDiscoveryDoc struct {
+	Issuer                string `json:"issuer"`
+	JWKSURI               string `json:"jwks_uri"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+	MTLSEndpointAliases   struct {
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+	} `json:"mtls_endpoint_aliases"`
+}
+
+// discoveryManager holds the last-known-good discovery document for an
+// issuer, refreshing it on a timer.
+type discoveryManager struct {
+	httpClient *http.Client
+	issuer     string
+	doc        atomic.Pointer[oidcDiscoveryDoc]
+}
+
+func newDiscoveryManager(issuer string, client *http.Client) (*discoveryManager, error) {
+	dm := &discoveryManager{httpClient: client, issuer: issuer}
+	if err := dm.refresh(); err != nil {
+		return nil, err
+	}
+	go func() {
+		t := time.NewTicker(discoveryRefreshEvery)
+		defer t.Stop()
+		for range t.C {
+			if err := dm.refresh(); err != nil {
+				logger.Warn("discovery refresh failed, keeping last-known-good", "issuer", dm.issuer, "error", err)
+			}
+		}
+	}()
+	return dm, nil
+}
+
+func (dm *discoveryManager) refresh() error {
+	doc, err := fetchDiscoveryDoc(dm.issuer, dm.httpClient)
+	if err != nil {
+		return err
+	}
+	dm.doc.Store(doc)
+	return nil
+}
+
+// current returns the last-known-good discovery document, or an error if
+// none has ever been fetched successfully.
+func (dm *discoveryManager) current() (*oidcDiscoveryDoc, error) {
+	doc := dm.doc.Load()
+	if doc == nil {
+		return nil, fmt.Errorf("no discovery document available for %s", dm.issuer)
+	}
+	return doc, nil
+}
+
+func fetchDiscoveryDoc(issuer string, client *http.Client) (*oidcDiscoveryDoc, error) {
+	wellKnown := strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := client.Get(wellKnown)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery status %d", resp.StatusCode)
+	}
+	var doc oidcDiscoveryDoc
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode discovery doc: %w", err)
+	}
+	return &doc, nil
+}
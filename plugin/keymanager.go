@@ -0,0 +1,353 @@
+// keymanager.go
+//
+// Local JWT verification against the authorization server's published JWKS.
+//
+// keyManager caches the key set at a given jwks_uri (resolved via discovery,
+// see discovery.go), parses RSA and EC keys, and caches public keys by kid.
+// Keys are refreshed on a background timer and, on a cache miss for an
+// unknown kid, an immediate refetch is triggered (debounced) so a rotated
+// signing key does not cause a flood of concurrent refetches.
+//
+// Env vars:
+//
+//	EXPECTED_AUDIENCE, JWKS_REFRESH_SECONDS (default 300)
+//	ENABLE_LOCAL_VALIDATION (default false)
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	expectedAudience = os.Getenv("EXPECTED_AUDIENCE")
+	jwksRefreshEvery = durationFromEnvSeconds("JWKS_REFRESH_SECONDS", 300)
+
+	keyMgrDebounce = 2 * time.Second
+)
+
+// jwk is a single entry of a JWK Set (RFC 7517), covering the RSA and EC
+// fields we support.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// keyManager caches JWKS-published public keys by kid and verifies compact
+// JWS tokens locally, without a round-trip to the authorization server.
+type keyManager struct {
+	httpClient *http.Client
+	jwksURI    string
+
+	mu            sync.RWMutex
+	keys          map[string]crypto.PublicKey
+	lastRefresh   time.Time
+	lastMissFetch time.Time
+}
+
+func newKeyManager(jwksURI string, client *http.Client) (*keyManager, error) {
+	if jwksURI == "" {
+		return nil, fmt.Errorf("jwks_uri is empty")
+	}
+	km := &keyManager{
+		httpClient: client,
+		jwksURI:    jwksURI,
+		keys:       map[string]crypto.PublicKey{},
+	}
+	if err := km.refresh(); err != nil {
+		return nil, fmt.Errorf("initial jwks fetch: %w", err)
+	}
+	go func() {
+		t := time.NewTicker(jwksRefreshEvery)
+		defer t.Stop()
+		for range t.C {
+			if err := km.refresh(); err != nil {
+				logger.Warn("jwks refresh failed", "error", err)
+			}
+		}
+	}()
+	return km, nil
+}
+
+func (km *keyManager) refresh() error {
+	resp, err := km.httpClient.Get(km.jwksURI)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("jwks status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var set jwkSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decode jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		pub, err := k.publicKey()
+		if err != nil {
+			logger.Warn("jwks: skipping key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	km.mu.Lock()
+	km.keys = keys
+	km.lastRefresh = time.Now()
+	km.mu.Unlock()
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("rsa n: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("rsa e: %w", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		curve, err := ecCurve(k.Crv)
+		if err != nil {
+			return nil, err
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("ec x: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("ec y: %w", err)
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported kty %q", k.Kty)
+	}
+}
+
+// getKey returns the cached public key for kid, triggering a debounced
+// refetch on miss so a just-rotated key becomes available without waiting
+// for the next ticker.
+func (km *keyManager) getKey(kid string) (crypto.PublicKey, bool) {
+	km.mu.RLock()
+	pub, ok := km.keys[kid]
+	km.mu.RUnlock()
+	if ok {
+		return pub, true
+	}
+
+	km.mu.Lock()
+	stale := time.Since(km.lastMissFetch) > keyMgrDebounce
+	if stale {
+		km.lastMissFetch = time.Now()
+	}
+	km.mu.Unlock()
+	if stale {
+		if err := km.refresh(); err != nil {
+			logger.Warn("jwks refetch on miss failed", "kid", kid, "error", err)
+			return nil, false
+		}
+	}
+
+	km.mu.RLock()
+	pub, ok = km.keys[kid]
+	km.mu.RUnlock()
+	return pub, ok
+}
+
+// verify checks the signature of a compact JWS and validates iss, aud, exp
+// and nbf (with clockSkew tolerance), returning the decoded claims.
+func (km *keyManager) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a compact JWS")
+	}
+
+	headerB, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("header b64 decode: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerB, &header); err != nil {
+		return nil, fmt.Errorf("header json: %w", err)
+	}
+
+	pub, ok := km.getKey(header.Kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", header.Kid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature b64 decode: %w", err)
+	}
+	signingInput := parts[0] + "." + parts[1]
+	if err := verifySignature(header.Alg, pub, signingInput, sig); err != nil {
+		return nil, err
+	}
+
+	payloadB, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("payload b64 decode: %w", err)
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payloadB, &claims); err != nil {
+		return nil, fmt.Errorf("payload json: %w", err)
+	}
+	if err := validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, pub crypto.PublicKey, signingInput string, sig []byte) error {
+	switch alg {
+	case "RS256", "RS384", "RS512":
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("alg %s requires an RSA key", alg)
+		}
+		hash, hashed := hashFor(alg, signingInput)
+		if err := rsa.VerifyPKCS1v15(rsaPub, hash, hashed, sig); err != nil {
+			return fmt.Errorf("rsa signature invalid: %w", err)
+		}
+		return nil
+	case "ES256", "ES384":
+		ecPub, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("alg %s requires an EC key", alg)
+		}
+		_, hashed := hashFor(alg, signingInput)
+		half := len(sig) / 2
+		if half == 0 {
+			return fmt.Errorf("ec signature too short")
+		}
+		r := new(big.Int).SetBytes(sig[:half])
+		s := new(big.Int).SetBytes(sig[half:])
+		if !ecdsa.Verify(ecPub, hashed, r, s) {
+			return fmt.Errorf("ec signature invalid")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+}
+
+func hashFor(alg, signingInput string) (crypto.Hash, []byte) {
+	switch alg {
+	case "RS384", "ES384":
+		sum := sha512.Sum384([]byte(signingInput))
+		return crypto.SHA384, sum[:]
+	case "RS512":
+		sum := sha512.Sum512([]byte(signingInput))
+		return crypto.SHA512, sum[:]
+	default: // RS256, ES256
+		sum := sha256.Sum256([]byte(signingInput))
+		return crypto.SHA256, sum[:]
+	}
+}
+
+func validateClaims(claims map[string]any) error {
+	now := time.Now()
+
+	if issuerURL != "" {
+		iss, _ := claims["iss"].(string)
+		if iss != issuerURL {
+			return fmt.Errorf("unexpected iss %q", iss)
+		}
+	}
+	if expectedAudience != "" && !audienceContains(claims["aud"], expectedAudience) {
+		return fmt.Errorf("aud does not contain %q", expectedAudience)
+	}
+	exp, ok := numericClaim(claims["exp"])
+	if !ok {
+		return fmt.Errorf("missing or invalid exp claim")
+	}
+	if now.After(time.Unix(exp, 0).Add(clockSkew)) {
+		return fmt.Errorf("token expired")
+	}
+	if nbf, ok := numericClaim(claims["nbf"]); ok {
+		if now.Before(time.Unix(nbf, 0).Add(-clockSkew)) {
+			return fmt.Errorf("token not yet valid")
+		}
+	}
+	return nil
+}
+
+func audienceContains(aud any, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []any:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func numericClaim(v any) (int64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return int64(t), true
+	case json.Number:
+		i, err := t.Int64()
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func ecCurve(crv string) (elliptic.Curve, error) {
+	switch crv {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	default:
+		return nil, fmt.Errorf("unsupported crv %q", crv)
+	}
+}
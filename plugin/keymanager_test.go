@@ -0,0 +1,206 @@
+// keymanager_test.go
+//
+// Table-driven unit tests for keyManager.verify/validateClaims/verifySignature:
+// happy-path RS256/ES256, alg/kty confusion, expiry/nbf, unknown kid and a
+// tampered signature.
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate rsa key: %v", err)
+	}
+	return key
+}
+
+func mustECKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ec key: %v", err)
+	}
+	return key
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// signJWT builds a compact JWS over claims, labeled with alg/kid in the
+// header and signed with key (an *rsa.PrivateKey or *ecdsa.PrivateKey). The
+// header's alg is independent of key's real type, so callers can construct
+// alg/kty-confused tokens.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatalf("marshal header: %v", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	signingInput := b64(header) + "." + b64(payload)
+
+	hash, hashed := hashFor(alg, signingInput)
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, hashed)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, hashed)
+		if err == nil {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			sig = make([]byte, 2*size)
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+		}
+	default:
+		t.Fatalf("unsupported key type %T", key)
+	}
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signingInput + "." + b64(sig)
+}
+
+func validTestClaims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss": "https://issuer.example",
+		"aud": "api://default",
+		"exp": now.Add(time.Hour).Unix(),
+		"nbf": now.Add(-time.Minute).Unix(),
+	}
+}
+
+func TestKeyManagerVerify(t *testing.T) {
+	origIssuer, origAud, origSkew := issuerURL, expectedAudience, clockSkew
+	issuerURL = "https://issuer.example"
+	expectedAudience = "api://default"
+	clockSkew = 30 * time.Second
+	t.Cleanup(func() {
+		issuerURL, expectedAudience, clockSkew = origIssuer, origAud, origSkew
+	})
+
+	rsaKey := mustRSAKey(t)
+	ecKey := mustECKey(t, elliptic.P256())
+
+	km := &keyManager{
+		keys: map[string]crypto.PublicKey{
+			"rsa-kid": &rsaKey.PublicKey,
+			"ec-kid":  &ecKey.PublicKey,
+		},
+		// Prevent getKey's debounced refetch-on-miss from dialing out on the
+		// "unknown kid" case below; there's no JWKS endpoint to refetch from here.
+		lastMissFetch: time.Now(),
+	}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr bool
+	}{
+		{
+			name:  "valid RS256",
+			token: func() string { return signJWT(t, "RS256", "rsa-kid", rsaKey, validTestClaims()) },
+		},
+		{
+			name:  "valid ES256",
+			token: func() string { return signJWT(t, "ES256", "ec-kid", ecKey, validTestClaims()) },
+		},
+		{
+			name:    "unknown kid",
+			token:   func() string { return signJWT(t, "RS256", "no-such-kid", rsaKey, validTestClaims()) },
+			wantErr: true,
+		},
+		{
+			name: "alg confusion: ES256 header signed by EC key but kid maps to RSA key",
+			token: func() string {
+				return signJWT(t, "ES256", "rsa-kid", ecKey, validTestClaims())
+			},
+			wantErr: true,
+		},
+		{
+			name: "kty confusion: RS256 header signed by RSA key but kid maps to EC key",
+			token: func() string {
+				return signJWT(t, "RS256", "ec-kid", rsaKey, validTestClaims())
+			},
+			wantErr: true,
+		},
+		{
+			name: "expired token",
+			token: func() string {
+				claims := validTestClaims()
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+				return signJWT(t, "RS256", "rsa-kid", rsaKey, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing exp claim",
+			token: func() string {
+				claims := validTestClaims()
+				delete(claims, "exp")
+				return signJWT(t, "RS256", "rsa-kid", rsaKey, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "not yet valid (nbf in future)",
+			token: func() string {
+				claims := validTestClaims()
+				claims["nbf"] = time.Now().Add(time.Hour).Unix()
+				return signJWT(t, "RS256", "rsa-kid", rsaKey, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				claims := validTestClaims()
+				claims["aud"] = "api://other"
+				return signJWT(t, "RS256", "rsa-kid", rsaKey, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "tampered signature",
+			token: func() string {
+				tok := signJWT(t, "RS256", "rsa-kid", rsaKey, validTestClaims())
+				parts := strings.Split(tok, ".")
+				sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+				if err != nil {
+					t.Fatalf("decode sig: %v", err)
+				}
+				sig[0] ^= 0xFF
+				parts[2] = base64.RawURLEncoding.EncodeToString(sig)
+				return strings.Join(parts, ".")
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := km.verify(tt.token())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -5,9 +5,17 @@
 //
 // Env vars:
 //
-//	INTROSPECTION_URL, CLIENT_ID, CLIENT_SECRET
+//	CLIENT_ID, CLIENT_SECRET
 //	PORT (default "50051"), TIMEOUT_SECONDS (default 2.5)
 //	CACHE_MAX_ENTRIES (default 10000), CACHE_JANITOR_SECONDS (default 60), CLOCK_SKEW_SECONDS (default 30)
+//
+// See discovery.go for the OIDC discovery bootstrap (ISSUER_URL,
+// DISCOVERY_REFRESH_SECONDS), oauthclient.go for introspection client
+// authentication (CLIENT_CERT_FILE, CLIENT_KEY_FILE, CLIENT_CA_FILE,
+// AUTH_METHOD), keymanager.go for local JWT validation (EXPECTED_AUDIENCE,
+// JWKS_REFRESH_SECONDS, ENABLE_LOCAL_VALIDATION), policy.go for the
+// PhantomAuthorize hook (POLICY_FILE), and metrics.go for the Prometheus
+// endpoint and structured logging (METRICS_ADDR, LOG_LEVEL).
 package main
 
 import (
@@ -17,15 +25,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"google.golang.org/grpc"
@@ -35,15 +42,12 @@ import (
 )
 
 var (
-	introspectionURL = os.Getenv("INTROSPECTION_URL")
-	clientID         = os.Getenv("CLIENT_ID")
-	clientSecret     = os.Getenv("CLIENT_SECRET")
-	bearerRe         = regexp.MustCompile(`(?i)^\s*Bearer\s+(.+)\s*$`)
-	httpClient       *http.Client
+	clientID     = os.Getenv("CLIENT_ID")
+	clientSecret = os.Getenv("CLIENT_SECRET")
+	bearerRe     = regexp.MustCompile(`(?i)^\s*Bearer\s+(.+)\s*$`)
+	httpClient   *http.Client
 
 	clockSkew    = durationFromEnvSeconds("CLOCK_SKEW_SECONDS", 30)
-	janitorEvery = durationFromEnvSeconds("CACHE_JANITOR_SECONDS", 60)
-	cacheMax     = intFromEnv("CACHE_MAX_ENTRIES", 10000)
 	introspectTO = durationFromEnvFloatSeconds("TIMEOUT_SECONDS", 2.5)
 )
 
@@ -51,107 +55,18 @@ func init() {
 	httpClient = &http.Client{Timeout: introspectTO}
 }
 
-// -------- Cache --------
-type cacheEntry struct {
-	JWT     string
-	Expires time.Time
-}
+// cStore is the phantom-JWT cache; see cache.go for the Cache interface and
+// its memory/Redis/etcd backends. Assigned in main() once CACHE_BACKEND has
+// been resolved.
+var cStore Cache
 
-type jwtCache struct {
-	mu   sync.RWMutex
-	data map[string]cacheEntry
-}
-
-func newJWTCache() *jwtCache {
-	c := &jwtCache{data: make(map[string]cacheEntry, 1024)}
-	go func() {
-		t := time.NewTicker(janitorEvery)
-		defer t.Stop()
-		for range t.C {
-			c.purgeExpired()
-			c.enforceCap()
-		}
-	}()
-	return c
-}
+// keyMgr is non-nil when ENABLE_LOCAL_VALIDATION is set, enabling local JWT
+// validation in addition to (or instead of) introspection.
+var keyMgr *keyManager
 
-func (c *jwtCache) get(key string) (string, bool) {
-	now := time.Now()
-	c.mu.RLock()
-	ce, ok := c.data[key]
-	c.mu.RUnlock()
-	if !ok {
-		return "", false
-	}
-	if now.After(ce.Expires) {
-		c.mu.Lock()
-		delete(c.data, key)
-		c.mu.Unlock()
-		return "", false
-	}
-	return ce.JWT, true
-}
-
-func (c *jwtCache) set(key, jwt string, exp time.Time) {
-	c.mu.Lock()
-	if time.Now().Add(clockSkew).Before(exp) {
-		c.data[key] = cacheEntry{JWT: jwt, Expires: exp}
-	}
-	c.mu.Unlock()
-}
-
-func (c *jwtCache) purgeExpired() {
-	now := time.Now()
-	c.mu.Lock()
-	for k, v := range c.data {
-		if now.After(v.Expires) {
-			delete(c.data, k)
-		}
-	}
-	c.mu.Unlock()
-}
-
-func (c *jwtCache) enforceCap() {
-	if cacheMax <= 0 {
-		return
-	}
-	c.mu.Lock()
-	n := len(c.data)
-	if n <= cacheMax {
-		c.mu.Unlock()
-		return
-	}
-	toDrop := n - cacheMax
-	type kv struct {
-		key string
-		exp time.Time
-	}
-	items := make([]kv, 0, n)
-	for k, v := range c.data {
-		items = append(items, kv{k, v.Expires})
-	}
-	now := time.Now()
-	dropped := 0
-	for _, it := range items {
-		if dropped >= toDrop {
-			break
-		}
-		if !it.exp.After(now) || it.exp.Sub(now) < 2*time.Minute {
-			delete(c.data, it.key)
-			dropped++
-		}
-	}
-	for k := range c.data {
-		if dropped >= toDrop {
-			break
-		}
-		delete(c.data, k)
-		dropped++
-	}
-	c.mu.Unlock()
-}
-
-var cStore = newJWTCache()
+// oauthClient authenticates and sends introspection requests against the
+// endpoint resolved from the issuer's discovery document.
+var oauthClient *introspectionClient
 
 // -------- Utilities --------
 func durationFromEnvSeconds(name string, def int) time.Duration {
@@ -178,6 +93,20 @@ func durationFromEnvFloatSeconds(name string, def float64) time.Duration {
 	return time.Duration(f * float64(time.Second))
 }
 
+// detachedTimeout bounds a new, independent context (rooted at
+// context.Background(), not ctx) to the shorter of ctx's own deadline and
+// def. Used where ctx's cancellation must not propagate to the returned
+// context but its deadline still should.
+func detachedTimeout(ctx context.Context, def time.Duration) (context.Context, context.CancelFunc) {
+	d := def
+	if dl, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(dl); remaining < d {
+			d = remaining
+		}
+	}
+	return context.WithTimeout(context.Background(), d)
+}
+
 func intFromEnv(name string, def int) int {
 	v := os.Getenv(name)
 	if v == "" {
@@ -206,32 +135,35 @@ func extractBearer(h string) string {
 	return strings.TrimSpace(m[1])
 }
 
-func parseJWTExp(jwt string) (time.Time, error) {
+// decodeJWTPayload base64-decodes and JSON-parses the claims set of a
+// compact JWS, without verifying its signature.
+func decodeJWTPayload(jwt string) (map[string]any, error) {
 	parts := strings.Split(jwt, ".")
 	if len(parts) != 3 {
-		return time.Time{}, fmt.Errorf("not a compact JWS")
+		return nil, fmt.Errorf("not a compact JWS")
 	}
 	payloadB, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return time.Time{}, fmt.Errorf("payload b64 decode: %w", err)
+		return nil, fmt.Errorf("payload b64 decode: %w", err)
 	}
 	var claims map[string]any
 	if err := json.Unmarshal(payloadB, &claims); err != nil {
-		return time.Time{}, fmt.Errorf("payload json: %w", err)
+		return nil, fmt.Errorf("payload json: %w", err)
+	}
+	return claims, nil
+}
+
+func parseJWTExp(jwt string) (time.Time, error) {
+	claims, err := decodeJWTPayload(jwt)
+	if err != nil {
+		return time.Time{}, err
 	}
 	expVal, ok := claims["exp"]
 	if !ok {
 		return time.Time{}, fmt.Errorf("no exp claim")
 	}
-	var expUnix int64
-	switch t := expVal.(type) {
-	case float64:
-		expUnix = int64(t)
-	case json.Number:
-		if v, err := t.Int64(); err == nil {
-			expUnix = v
-		}
-	default:
+	expUnix, ok := numericClaim(expVal)
+	if !ok {
 		return time.Time{}, fmt.Errorf("exp type unsupported")
 	}
 	return time.Unix(expUnix, 0), nil
@@ -247,26 +179,97 @@ func main() {
 	if port == "" {
 		port = "50051"
 	}
-	if introspectionURL == "" || clientID == "" || clientSecret == "" {
-		log.Fatal("INTROSPECTION_URL, CLIENT_ID, and CLIENT_SECRET must be set")
+	if issuerURL == "" || clientID == "" {
+		fatal("ISSUER_URL and CLIENT_ID must be set")
+	}
+	if (authMethod == "" || authMethod == "basic" || authMethod == "client_secret_post") && clientSecret == "" {
+		fatal("CLIENT_SECRET must be set", "auth_method", authMethod)
+	}
+
+	dm, err := newDiscoveryManager(issuerURL, httpClient)
+	if err != nil {
+		fatal("discovery", "error", err)
+	}
+
+	oc, err := newIntrospectionClient(dm)
+	if err != nil {
+		fatal("introspection client", "error", err)
+	}
+	oauthClient = oc
+
+	cache, err := newCache()
+	if err != nil {
+		fatal("cache", "error", err)
+	}
+	cStore = cache
+
+	if policyFile := os.Getenv("POLICY_FILE"); policyFile != "" {
+		p, err := loadPolicies(policyFile)
+		if err != nil {
+			fatal("policy", "error", err)
+		}
+		policies = p
+	}
+
+	if boolFromEnv("ENABLE_LOCAL_VALIDATION", false) {
+		doc, err := dm.current()
+		if err != nil {
+			fatal("jwks", "error", err)
+		}
+		km, err := newKeyManager(doc.JWKSURI, httpClient)
+		if err != nil {
+			fatal("jwks", "error", err)
+		}
+		keyMgr = km
 	}
 
+	serveMetrics()
+
 	lis, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		log.Fatalf("listen: %v", err)
+		fatal("listen", "error", err)
 	}
 	s := grpc.NewServer()
 	coprocess.RegisterDispatcherServer(s, &server{})
-	log.Printf("Phantom token gRPC plugin listening on :%s", port)
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("serve: %v", err)
+	logger.Info("phantom token gRPC plugin listening", "port", port)
+
+	shutdownTimeout := durationFromEnvSeconds("SHUTDOWN_TIMEOUT", 30)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- s.Serve(lis)
+	}()
+
+	select {
+	case err := <-serveErrCh:
+		if err != nil {
+			fatal("serve", "error", err)
+		}
+	case sig := <-sigCh:
+		logger.Info("received signal, draining in-flight requests", "signal", sig.String(), "timeout", shutdownTimeout.String())
+		stopped := make(chan struct{})
+		go func() {
+			s.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			logger.Info("graceful shutdown complete")
+		case <-time.After(shutdownTimeout):
+			logger.Warn("graceful shutdown timed out, forcing stop")
+			s.Stop()
+		}
 	}
 }
 
 func (s *server) Dispatch(ctx context.Context, obj *coprocess.Object) (*coprocess.Object, error) {
 	switch obj.HookName {
 	case "PhantomAuthCheck":
-		return phantomAuthCheck(obj)
+		return phantomAuthCheck(ctx, obj)
+	case "PhantomAuthorize":
+		return phantomAuthorize(obj)
 	case "InjectJwtPostKeyAuth":
 		return injectJwtPostKeyAuth(obj)
 	default:
@@ -275,71 +278,124 @@ func (s *server) Dispatch(ctx context.Context, obj *coprocess.Object) (*coproces
 }
 
 // ---- Hook 1: auth_check ----
-func phantomAuthCheck(obj *coprocess.Object) (*coprocess.Object, error) {
+func phantomAuthCheck(ctx context.Context, obj *coprocess.Object) (*coprocess.Object, error) {
+	start := time.Now()
 	auth := obj.GetRequest().GetHeaders()["Authorization"]
 	opaque := extractBearer(auth)
 	if opaque == "" {
+		logHook("PhantomAuthCheck", "", "n/a", start, nil)
 		return unauthorized(obj, "Missing bearer token"), nil
 	}
 
 	key := sha256Hex(opaque)
-	if jwt, ok := cStore.get(key); ok {
+	if jwt, ok := cStore.Get(key); ok {
+		if keyMgr != nil {
+			if _, err := keyMgr.verify(jwt); err != nil {
+				cStore.Delete(key)
+				claimsCache.Delete(key) // keep policy.go's parsed-claims cache coherent with cStore
+				logHook("PhantomAuthCheck", opaque, "hit-invalid", start, err)
+				return unauthorized(obj, fmt.Sprintf("Cached token failed local validation: %v", err)), nil
+			}
+		}
 		ensureMetadata(obj)
 		obj.Metadata["phantom_jwt"] = jwt
 		obj.Metadata["token"] = opaque
 		ensureSession(obj)
+		logHook("PhantomAuthCheck", opaque, "hit", start, nil)
 		return obj, nil
 	}
 
-	jwt, exp, err := introspectForJWTAndExp(opaque)
+	// If the opaque token is itself a structured JWT and local validation is
+	// configured, verify it directly and skip the introspection round-trip.
+	if keyMgr != nil && countDots(opaque) == 2 {
+		if claims, err := keyMgr.verify(opaque); err == nil {
+			exp, _ := numericClaim(claims["exp"])
+			ttl := time.Until(time.Unix(exp, 0).Add(-clockSkew))
+			cStore.Set(key, opaque, ttl)
+			jwtTTLSeconds.Observe(ttl.Seconds())
+
+			ensureMetadata(obj)
+			obj.Metadata["phantom_jwt"] = opaque
+			obj.Metadata["token"] = opaque
+			ensureSession(obj)
+			logHook("PhantomAuthCheck", opaque, "miss-local-validation", start, nil)
+			return obj, nil
+		}
+	}
+
+	jwt, exp, err := introspectCoalesced(ctx, opaque)
 	if err != nil {
+		logHook("PhantomAuthCheck", opaque, "miss", start, err)
 		return unauthorized(obj, fmt.Sprintf("Introspection error: %v", err)), nil
 	}
 	if jwt == "" {
+		logHook("PhantomAuthCheck", opaque, "miss-inactive", start, nil)
 		return unauthorized(obj, "Token inactive or invalid"), nil
 	}
 
-	storeUntil := exp.Add(-clockSkew)
-	cStore.set(key, jwt, storeUntil)
+	ttl := time.Until(exp.Add(-clockSkew))
+	cStore.Set(key, jwt, ttl)
+	jwtTTLSeconds.Observe(ttl.Seconds())
 
 	ensureMetadata(obj)
 	obj.Metadata["phantom_jwt"] = jwt
 	obj.Metadata["token"] = opaque
 	ensureSession(obj)
+	logHook("PhantomAuthCheck", opaque, "miss", start, nil)
 	return obj, nil
 }
 
 // ---- Hook 2: post_key_auth ----
 func injectJwtPostKeyAuth(obj *coprocess.Object) (*coprocess.Object, error) {
+	start := time.Now()
 	jwt := ""
+	opaque := ""
 	if obj.Metadata != nil {
 		jwt = obj.Metadata["phantom_jwt"]
+		opaque = obj.Metadata["token"]
 	}
 	if jwt == "" {
+		logHook("InjectJwtPostKeyAuth", opaque, "n/a", start, nil)
 		return unauthorized(obj, "JWT missing post-auth"), nil
 	}
 	if obj.Request.SetHeaders == nil {
 		obj.Request.SetHeaders = map[string]string{}
 	}
 	obj.Request.SetHeaders["Authorization"] = "Bearer " + jwt
+	logHook("InjectJwtPostKeyAuth", opaque, "n/a", start, nil)
 	return obj, nil
 }
 
 // -------- Introspection --------
 
-func introspectForJWTAndExp(opaque string) (string, time.Time, error) {
-	form := url.Values{}
-	form.Set("token", opaque)
+func introspectForJWTAndExp(ctx context.Context, opaque string) (string, time.Time, error) {
+	start := time.Now()
+	jwt, exp, err := doIntrospect(ctx, opaque)
+	introspectionDuration.Observe(time.Since(start).Seconds())
 
-	req, err := http.NewRequest(http.MethodPost, introspectionURL, strings.NewReader(form.Encode()))
-	if err != nil {
-		return "", time.Time{}, err
+	switch {
+	case err != nil:
+		introspectionRequestsTotal.WithLabelValues("error").Inc()
+	case jwt == "":
+		introspectionRequestsTotal.WithLabelValues("inactive").Inc()
+	default:
+		introspectionRequestsTotal.WithLabelValues("active").Inc()
 	}
-	req.Header.Set("Accept", "application/jwt")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(clientID, clientSecret)
+	return jwt, exp, err
+}
 
-	resp, err := httpClient.Do(req)
+func doIntrospect(ctx context.Context, opaque string) (string, time.Time, error) {
+	// This call may be shared across several coalesced requests (see
+	// introspectCoalesced in singleflight.go), so it must not inherit ctx's
+	// cancellation: one caller's gateway disconnecting would otherwise abort
+	// the in-flight introspection for every other request waiting on the
+	// same result. It still honors whichever is shorter of that caller's own
+	// deadline and TIMEOUT_SECONDS, just via a detached timeout rather than
+	// by inheriting ctx itself.
+	ctx, cancel := detachedTimeout(ctx, introspectTO)
+	defer cancel()
+
+	resp, err := oauthClient.introspect(ctx, opaque)
 	if err != nil {
 		return "", time.Time{}, err
 	}
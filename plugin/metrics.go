@@ -0,0 +1,175 @@
+// metrics.go
+//
+// Prometheus metrics and structured (log/slog) logging.
+//
+// Metrics are served on METRICS_ADDR at /metrics and cover the phantom-JWT
+// cache (hits, misses, size, evictions), introspection (request counts by
+// result, latency) and singleflight coalescing. Hook invocations are logged
+// as a single structured JSON line each via logHook, carrying the hook name,
+// cache outcome, a truncated token hash (never the token itself), duration
+// and error class, so operators can correlate a slow or failing request
+// with the metrics above without exposing credentials in logs.
+//
+// Env vars:
+//
+//	METRICS_ADDR (default ":9090"), LOG_LEVEL (default "info")
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsAddr = envOrDefault("METRICS_ADDR", ":9090")
+
+var (
+	cacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "phantom_cache_hits_total",
+		Help: "Phantom JWT cache hits.",
+	})
+	cacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "phantom_cache_misses_total",
+		Help: "Phantom JWT cache misses.",
+	})
+	cacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "phantom_cache_size",
+		Help: "Entries currently held by the in-memory phantom JWT cache.",
+	})
+	cacheEvictionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "phantom_cache_evictions_total",
+		Help: "Phantom JWT cache evictions, by reason.",
+	}, []string{"reason"})
+)
+
+// cacheMetrics bundles the counters/gauge a memoryCache instance reports to;
+// only cStore's memory backend carries one (see jwtCacheMetrics below) so
+// the unrelated negativeCache (singleflight.go) and claimsCache (policy.go)
+// in-memory caches don't stomp on phantom_cache_* readings meant for the
+// JWT cache alone.
+type cacheMetrics struct {
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	size      prometheus.Gauge
+	evictions *prometheus.CounterVec
+}
+
+var jwtCacheMetrics = &cacheMetrics{
+	hits:      cacheHitsTotal,
+	misses:    cacheMissesTotal,
+	size:      cacheSize,
+	evictions: cacheEvictionsTotal,
+}
+
+var (
+	introspectionRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "phantom_introspection_requests_total",
+		Help: "Introspection calls to the authorization server, by result.",
+	}, []string{"result"})
+	introspectionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "phantom_introspection_duration_seconds",
+		Help:    "Introspection round-trip latency.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	jwtTTLSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "phantom_jwt_ttl_seconds",
+		Help:    "TTL assigned to phantom JWTs when cached.",
+		Buckets: []float64{5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	})
+
+	singleflightDedupTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "phantom_singleflight_dedup_total",
+		Help: "Introspection calls served by singleflight dedup instead of a new round-trip.",
+	})
+	negativeCacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "phantom_negative_cache_hits_total",
+		Help: "Requests answered from the negative introspection-result cache.",
+	})
+)
+
+// logger is the process-wide structured logger; its level is fixed at
+// startup from LOG_LEVEL.
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel()}))
+
+func logLevel() slog.Level {
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// serveMetrics starts the /metrics endpoint in the background. It does not
+// block startup and does not take the plugin down if the listener fails;
+// metrics are operationally useful but not load-bearing.
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+			logger.Error("metrics server stopped", "error", err)
+		}
+	}()
+	logger.Info("serving metrics", "addr", metricsAddr)
+}
+
+// tokenPrefix returns a short, non-reversible prefix of the opaque token's
+// hash, safe to log alongside the full sha256Hex cache key.
+func tokenPrefix(opaque string) string {
+	h := sha256Hex(opaque)
+	if len(h) > 12 {
+		return h[:12]
+	}
+	return h
+}
+
+// errorClass buckets an error into a small, stable set of log/alert
+// categories instead of free-text messages.
+func errorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "error"
+	}
+}
+
+// fatal logs msg at error level with args and exits(1); it replaces
+// log.Fatal/Fatalf now that startup logging goes through slog.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logHook emits one structured JSON line per hook invocation.
+func logHook(hookName, opaque, cacheOutcome string, start time.Time, err error) {
+	attrs := []any{
+		"hook", hookName,
+		"cache", cacheOutcome,
+		"token_sha256_prefix", tokenPrefix(opaque),
+		"duration_ms", time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		logger.Error("phantom token hook", append(attrs, "error_class", errorClass(err), "error", err.Error())...)
+		return
+	}
+	logger.Info("phantom token hook", attrs...)
+}
@@ -0,0 +1,258 @@
+// oauthclient.go
+//
+// Discovery-driven introspection client. The introspection endpoint is
+// resolved from the issuer's discovery document (discovery.go); the mTLS
+// alias (RFC 8705 mtls_endpoint_aliases.introspection_endpoint) is preferred
+// automatically once a client certificate is configured. Client
+// authentication is selected via AUTH_METHOD.
+//
+// Env vars:
+//
+//	CLIENT_ID, CLIENT_SECRET
+//	CLIENT_CERT_FILE, CLIENT_KEY_FILE, CLIENT_CA_FILE
+//	AUTH_METHOD={basic,client_secret_post,private_key_jwt,tls_client_auth} (default "basic")
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	authMethod     = envOrDefault("AUTH_METHOD", "basic")
+	clientCertFile = os.Getenv("CLIENT_CERT_FILE")
+	clientKeyFile  = os.Getenv("CLIENT_KEY_FILE")
+	clientCAFile   = os.Getenv("CLIENT_CA_FILE")
+)
+
+// introspectionClient authenticates and sends RFC 7662 introspection
+// requests against the endpoint published by the issuer's discovery
+// document.
+type introspectionClient struct {
+	discovery  *discoveryManager
+	httpClient *http.Client
+	signingKey crypto.Signer // only set for AUTH_METHOD=private_key_jwt
+}
+
+func newIntrospectionClient(dm *discoveryManager) (*introspectionClient, error) {
+	client := httpClient
+	hasClientCert := clientCertFile != "" && clientKeyFile != ""
+	if hasClientCert {
+		tlsClient, err := newMTLSHTTPClient()
+		if err != nil {
+			return nil, fmt.Errorf("client mTLS config: %w", err)
+		}
+		client = tlsClient
+	}
+
+	ic := &introspectionClient{discovery: dm, httpClient: client}
+	if authMethod == "private_key_jwt" {
+		key, err := loadSigningKey(clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("private_key_jwt signing key: %w", err)
+		}
+		ic.signingKey = key
+	}
+	return ic, nil
+}
+
+func newMTLSHTTPClient() (*http.Client, error) {
+	cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load client cert/key: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CLIENT_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CLIENT_CA_FILE")
+		}
+		tlsCfg.RootCAs = pool
+	}
+	return &http.Client{
+		Timeout:   introspectTO,
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+	}, nil
+}
+
+// endpoint picks the mTLS alias (RFC 8705) when a client certificate is
+// configured, falling back to the plain introspection_endpoint.
+func (ic *introspectionClient) endpoint(doc *oidcDiscoveryDoc) (string, error) {
+	if clientCertFile != "" && doc.MTLSEndpointAliases.IntrospectionEndpoint != "" {
+		return doc.MTLSEndpointAliases.IntrospectionEndpoint, nil
+	}
+	if doc.IntrospectionEndpoint == "" {
+		return "", fmt.Errorf("discovery doc for %s has no introspection_endpoint", issuerURL)
+	}
+	return doc.IntrospectionEndpoint, nil
+}
+
+func (ic *introspectionClient) introspect(ctx context.Context, opaque string) (*http.Response, error) {
+	doc, err := ic.discovery.current()
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := ic.endpoint(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("token", opaque)
+	if err := ic.addFormCredentials(form, endpoint); err != nil {
+		return nil, fmt.Errorf("client authentication: %w", err)
+	}
+
+	// form must be complete before the request is built: net/http only sets
+	// Content-Length from a Request built with its body already in hand, and
+	// introspection endpoints commonly reject a chunked POST.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jwt")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if authMethod == "" || authMethod == "basic" {
+		req.SetBasicAuth(clientID, clientSecret)
+	}
+
+	return ic.httpClient.Do(req)
+}
+
+// addFormCredentials fills in the client credentials for form per
+// AUTH_METHOD, for every method except "basic" (applied as a request header
+// in introspect instead, since it isn't a form field).
+func (ic *introspectionClient) addFormCredentials(form url.Values, endpoint string) error {
+	switch authMethod {
+	case "", "basic":
+	case "client_secret_post":
+		form.Set("client_id", clientID)
+		form.Set("client_secret", clientSecret)
+	case "tls_client_auth":
+		form.Set("client_id", clientID)
+	case "private_key_jwt":
+		assertion, err := ic.clientAssertion(endpoint)
+		if err != nil {
+			return err
+		}
+		form.Set("client_id", clientID)
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", assertion)
+	default:
+		return fmt.Errorf("unsupported AUTH_METHOD %q", authMethod)
+	}
+	return nil
+}
+
+// clientAssertion builds and signs a client assertion JWT per RFC 7523.
+func (ic *introspectionClient) clientAssertion(aud string) (string, error) {
+	now := time.Now()
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("generate jti: %w", err)
+	}
+
+	var alg string
+	switch ic.signingKey.Public().(type) {
+	case *rsa.PublicKey:
+		alg = "RS256"
+	case *ecdsa.PublicKey:
+		alg = "ES256"
+	default:
+		return "", fmt.Errorf("unsupported signing key type %T", ic.signingKey.Public())
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": aud,
+		"exp": now.Add(60 * time.Second).Unix(),
+		"iat": now.Unix(),
+		"jti": hex.EncodeToString(jti),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sig, err := signAssertion(ic.signingKey, alg, signingInput)
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func signAssertion(key crypto.Signer, alg, signingInput string) ([]byte, error) {
+	hash, hashed := hashFor(alg, signingInput)
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, k, hash, hashed)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hashed)
+		if err != nil {
+			return nil, err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+}
+
+func loadSigningKey(keyFile string) (crypto.Signer, error) {
+	if keyFile == "" {
+		return nil, fmt.Errorf("CLIENT_KEY_FILE must be set for AUTH_METHOD=private_key_jwt")
+	}
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", keyFile)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key format in %s: %w", keyFile, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key in %s is not a signing key", keyFile)
+	}
+	return signer, nil
+}
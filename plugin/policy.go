@@ -0,0 +1,249 @@
+// policy.go
+//
+// Scope and claim-based request authorization (hook 3: PhantomAuthorize).
+//
+// Policies are loaded from POLICY_FILE (YAML), keyed by API ID or URL
+// pattern, and evaluated against the claims of the already-issued phantom
+// JWT before the request reaches the upstream. A policy can require:
+//
+//   - required_scopes: every listed scope must be present in the JWT's
+//     space-delimited "scope" claim
+//   - required_claims: each entry matches an exact claim value ("equals")
+//     or checks that a claim holding a list contains one of the given
+//     values ("in"), addressing nested claims with a dotted path
+//     (e.g. "realm_access.roles")
+//
+// Env vars:
+//
+//	POLICY_FILE
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	coprocess "github.com/curityio/tyk-phantom-token-plugin/internal/coprocess"
+)
+
+type claimMatch struct {
+	Claim  string `yaml:"claim"`
+	Equals any    `yaml:"equals"`
+	In     []any  `yaml:"in"`
+}
+
+type policy struct {
+	APIID          string       `yaml:"api_id"`
+	URLPattern     string       `yaml:"url_pattern"`
+	RequiredScopes []string     `yaml:"required_scopes"`
+	RequiredClaims []claimMatch `yaml:"required_claims"`
+}
+
+type policyFile struct {
+	Policies []policy `yaml:"policies"`
+}
+
+// policies is populated once at startup from POLICY_FILE; a nil/empty slice
+// means PhantomAuthorize is a no-op.
+var policies []policy
+
+func loadPolicies(path string) ([]policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read POLICY_FILE: %w", err)
+	}
+	var pf policyFile
+	if err := yaml.Unmarshal(b, &pf); err != nil {
+		return nil, fmt.Errorf("parse POLICY_FILE: %w", err)
+	}
+	return pf.Policies, nil
+}
+
+// claimsCache memoizes parsed phantom-JWT claims by the same key used for
+// cStore, so a policy check on a repeat request does not re-parse the JWT
+// payload.
+var claimsCache = newMemoryCache()
+
+func cachedClaims(key, jwt string) (map[string]any, error) {
+	if s, ok := claimsCache.Get(key); ok {
+		var claims map[string]any
+		if err := json.Unmarshal([]byte(s), &claims); err == nil {
+			return claims, nil
+		}
+	}
+
+	claims, err := decodeJWTPayload(jwt)
+	if err != nil {
+		return nil, err
+	}
+	// Only cache claims for a JWT with a live, parseable exp; an expired or
+	// unparseable exp must not be served stale out of claimsCache, so skip
+	// caching entirely rather than falling back to an arbitrary TTL.
+	if exp, ok := numericClaim(claims["exp"]); ok {
+		if ttl := time.Until(time.Unix(exp, 0)); ttl > 0 {
+			if b, err := json.Marshal(claims); err == nil {
+				claimsCache.Set(key, string(b), ttl)
+			}
+		}
+	}
+	return claims, nil
+}
+
+// ---- Hook 3: authorize ----
+func phantomAuthorize(obj *coprocess.Object) (*coprocess.Object, error) {
+	start := time.Now()
+	if len(policies) == 0 {
+		logHook("PhantomAuthorize", "", "no-policies", start, nil)
+		return obj, nil
+	}
+
+	jwt := ""
+	opaque := ""
+	if obj.Metadata != nil {
+		jwt = obj.Metadata["phantom_jwt"]
+		opaque = obj.Metadata["token"]
+	}
+	if jwt == "" {
+		logHook("PhantomAuthorize", opaque, "n/a", start, nil)
+		return unauthorized(obj, "JWT missing pre-authorize"), nil
+	}
+
+	p := matchPolicy(obj)
+	if p == nil {
+		logHook("PhantomAuthorize", opaque, "no-match", start, nil)
+		return obj, nil
+	}
+
+	claims, err := cachedClaims(sha256Hex(opaque), jwt)
+	if err != nil {
+		logHook("PhantomAuthorize", opaque, "unparsable", start, err)
+		return forbidden(obj, fmt.Sprintf("Unable to parse phantom token: %v", err)), nil
+	}
+
+	if !hasRequiredScopes(claims, p.RequiredScopes) {
+		logHook("PhantomAuthorize", opaque, "denied", start, nil)
+		return forbidden(obj, "Missing required scope"), nil
+	}
+	for _, m := range p.RequiredClaims {
+		if !evaluateClaimMatch(claims, m) {
+			logHook("PhantomAuthorize", opaque, "denied", start, nil)
+			return forbidden(obj, "Missing required claim"), nil
+		}
+	}
+	logHook("PhantomAuthorize", opaque, "allowed", start, nil)
+	return obj, nil
+}
+
+// matchPolicy prefers an exact API ID match, falling back to the first
+// policy whose URL pattern matches the request path.
+func matchPolicy(obj *coprocess.Object) *policy {
+	apiID := obj.Spec["APIID"]
+	for i := range policies {
+		if policies[i].APIID != "" && policies[i].APIID == apiID {
+			return &policies[i]
+		}
+	}
+
+	url := obj.GetRequest().GetUrl()
+	for i := range policies {
+		if policies[i].URLPattern == "" {
+			continue
+		}
+		if ok, _ := path.Match(policies[i].URLPattern, url); ok {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+func hasRequiredScopes(claims map[string]any, required []string) bool {
+	if len(required) == 0 {
+		return true
+	}
+	scopeStr, _ := claims["scope"].(string)
+	granted := map[string]bool{}
+	for _, s := range strings.Fields(scopeStr) {
+		granted[s] = true
+	}
+	for _, r := range required {
+		if !granted[r] {
+			return false
+		}
+	}
+	return true
+}
+
+func evaluateClaimMatch(claims map[string]any, m claimMatch) bool {
+	val, ok := resolveClaimPath(claims, m.Claim)
+	if !ok {
+		return false
+	}
+	if m.Equals != nil {
+		return fmt.Sprintf("%v", val) == fmt.Sprintf("%v", m.Equals)
+	}
+	if len(m.In) > 0 {
+		return claimValueIntersects(val, m.In)
+	}
+	return false
+}
+
+// resolveClaimPath walks a dotted path (e.g. "realm_access.roles") through
+// nested claim objects.
+func resolveClaimPath(claims map[string]any, claimPath string) (any, bool) {
+	var cur any = claims
+	for _, part := range strings.Split(claimPath, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// claimValueIntersects reports whether val (a scalar or a list) contains
+// any of the candidates in want.
+func claimValueIntersects(val any, want []any) bool {
+	values, ok := val.([]any)
+	if !ok {
+		values = []any{val}
+	}
+	for _, v := range values {
+		for _, w := range want {
+			if fmt.Sprintf("%v", v) == fmt.Sprintf("%v", w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forbidden mirrors unauthorized but short-circuits with 403 and the
+// insufficient_scope error per RFC 6750 section 3.1.
+func forbidden(obj *coprocess.Object, msg string) *coprocess.Object {
+	if obj.Request == nil {
+		obj.Request = &coprocess.MiniRequestObject{}
+	}
+	if obj.Request.ReturnOverrides == nil {
+		obj.Request.ReturnOverrides = &coprocess.ReturnOverrides{}
+	}
+	if obj.Request.ReturnOverrides.Headers == nil {
+		obj.Request.ReturnOverrides.Headers = map[string]string{}
+	}
+
+	obj.Request.ReturnOverrides.ResponseCode = 403
+	obj.Request.ReturnOverrides.ResponseError = msg
+	obj.Request.ReturnOverrides.ResponseBody = msg
+	obj.Request.ReturnOverrides.Headers["WWW-Authenticate"] = fmt.Sprintf(`Bearer error="insufficient_scope", error_description=%q`, msg)
+	obj.Request.ReturnOverrides.OverrideError = true
+
+	return obj
+}
@@ -0,0 +1,77 @@
+// singleflight.go
+//
+// Coalesces concurrent introspection calls for the same opaque token so a
+// burst of parallel requests produces one introspection round-trip instead
+// of N, and shields the authorization server from repeated bad-token
+// storms via a short-lived negative-result cache.
+//
+// Env vars:
+//
+//	NEGATIVE_CACHE_SECONDS (default 5)
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	negativeCacheTTL = durationFromEnvSeconds("NEGATIVE_CACHE_SECONDS", 5)
+	negativeCache    = newMemoryCache()
+
+	introspectGroup singleflight.Group
+)
+
+const negativeCacheValue = "inactive"
+
+type introspectResult struct {
+	jwt string
+	exp time.Time
+}
+
+// introspectCoalesced wraps introspectForJWTAndExp so that concurrent
+// requests for the same opaque token share a single in-flight introspection
+// call, and repeated requests for a token the AS just rejected are answered
+// from a short-lived negative cache instead of re-introspecting.
+//
+// singleflight.Group.Do is synchronous: every coalesced caller blocks until
+// the one shared call returns, regardless of whose ctx triggered it. The ctx
+// passed to introspectForJWTAndExp is only used to read a deadline (see
+// detachedTimeout in main.go) — its cancellation is deliberately not
+// propagated, so one caller's gateway disconnecting can't abort the
+// in-flight introspection for every other request coalesced onto it.
+func introspectCoalesced(ctx context.Context, opaque string) (string, time.Time, error) {
+	key := sha256Hex(opaque)
+	if v, ok := negativeCache.Get(key); ok {
+		negativeCacheHitsTotal.Inc()
+		if msg, isErr := strings.CutPrefix(v, "error: "); isErr {
+			return "", time.Time{}, fmt.Errorf("%s", msg)
+		}
+		return "", time.Time{}, nil
+	}
+
+	// Do reports shared=true to the caller that ran fn as well as to those
+	// that waited on it; only the latter count as dedup hits.
+	leader := false
+	v, err, shared := introspectGroup.Do(key, func() (any, error) {
+		leader = true
+		jwt, exp, err := introspectForJWTAndExp(ctx, opaque)
+		return introspectResult{jwt: jwt, exp: exp}, err
+	})
+	if shared && !leader {
+		singleflightDedupTotal.Inc()
+	}
+	if err != nil {
+		negativeCache.Set(key, fmt.Sprintf("error: %v", err), negativeCacheTTL)
+		return "", time.Time{}, err
+	}
+	res := v.(introspectResult)
+	if res.jwt == "" {
+		negativeCache.Set(key, negativeCacheValue, negativeCacheTTL)
+	}
+	return res.jwt, res.exp, nil
+}